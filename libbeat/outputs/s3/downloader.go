@@ -0,0 +1,98 @@
+package s3
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/elastic/beats/libbeat/logp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Downloader fetches objects written by fileManager back off S3, restoring
+// the original file's mtime from the x-amz-meta-mtime metadata that
+// s3Upload stamped on the object.
+type Downloader struct {
+	Region string
+	Bucket string
+
+	Endpoint         string
+	AccessKey        string
+	SecretKey        string
+	SessionToken     string
+	DisableSSL       bool
+	S3ForcePathStyle bool
+}
+
+func (d *Downloader) session() (*session.Session, error) {
+	cfg := aws.NewConfig().WithRegion(d.Region)
+	if d.Endpoint != "" {
+		cfg = cfg.WithEndpoint(d.Endpoint).WithDisableSSL(d.DisableSSL).WithS3ForcePathStyle(d.S3ForcePathStyle)
+	}
+	if d.AccessKey != "" && d.SecretKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(d.AccessKey, d.SecretKey, d.SessionToken))
+	}
+	return session.NewSession(cfg)
+}
+
+// Download fetches key into destPath and, if the object carries mtime
+// metadata, restores it with os.Chtimes.
+func (d *Downloader) Download(key string, destPath string) error {
+	sess, err := d.session()
+	if err != nil {
+		logp.Info("S3 downloader failed to create session: %v", err)
+		return err
+	}
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	downloader := s3manager.NewDownloader(sess)
+	_, err = downloader.Download(out, &s3.GetObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logp.Info("S3 download failure: %v", err)
+		return err
+	}
+
+	head, err := s3.New(sess).HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logp.Info("S3 downloader failed to head %s for metadata: %v", key, err)
+		return nil
+	}
+
+	if mtime, ok := metadataTime(head.Metadata, "mtime"); ok {
+		if err := os.Chtimes(destPath, mtime, mtime); err != nil {
+			logp.Info("S3 downloader failed to restore mtime on %s: %v", destPath, err)
+		}
+	}
+
+	return nil
+}
+
+// metadataTime looks up an S3 object metadata value case-insensitively (the
+// SDK title-cases header names on the way back) and parses it as RFC3339Nano.
+func metadataTime(metadata map[string]*string, key string) (time.Time, bool) {
+	for k, v := range metadata {
+		if v == nil || !strings.EqualFold(k, key) {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, *v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
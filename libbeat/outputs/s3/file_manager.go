@@ -1,41 +1,172 @@
 package s3
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	//"github.com/aws/aws-sdk-go/aws/awsutil"
-	"github.com/elastic/beats/libbeat/logp"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
-	//"github.com/aws/aws-sdk-go/aws/credentials"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	//"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 )
 
 const managerMaxFiles = 1024
 const defaultKeepFiles = 7
 const defaultUploadEveryBytes = 10 * 1024 * 1024
 const defaultUploadEverySeconds = 0
+const defaultUploadConcurrency = 1
+const defaultUploadMaxRetries = 3
+const uploadQueueDepth = managerMaxFiles
+const uploadRetryBaseDelay = time.Second
+
+// keyTemplateDefault reproduces the original hard-coded /YYYY/MM/DD/HOST_ISO8601
+// layout, kept as the default for backward compatibility.
+const keyTemplateDefault = `/{{.Time.Format "2006/01/02"}}/{{.Hostname}}_{{.Time.Format "20060102T150405.000000000Z"}}`
+
+// keyTemplatePresets are convenient names for KeyTemplate; anything else is
+// parsed as a literal text/template.
+var keyTemplatePresets = map[string]string{
+	"default": keyTemplateDefault,
+	// hourly buckets, useful for partitioning high-volume logs
+	"hourly": `/{{.Time.Format "2006/01/02/15"}}/{{.Hostname}}_{{.Time.Format "20060102T150405.000000000Z"}}`,
+	// Hive-style partitioning for Athena/Glue crawlers
+	"hive": `year={{.Time.Format "2006"}}/month={{.Time.Format "01"}}/day={{.Time.Format "02"}}/{{.Hostname}}_{{.Time.Format "20060102T150405.000000000Z"}}`,
+}
+
+const defaultCompression = "gzip"
+
+// compressionExtensions and compressionContentEncoding are indexed by
+// manager.Compression; "none" has no entry in either since it needs no
+// suffix and no Content-Encoding header.
+var compressionExtensions = map[string]string{
+	"gzip":   ".gz",
+	"zstd":   ".zst",
+	"snappy": ".snappy",
+}
+
+var compressionContentEncoding = map[string]string{
+	"gzip":   "gzip",
+	"zstd":   "zstd",
+	"snappy": "snappy",
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCompressWriter wraps w with the configured compression, or returns w
+// unchanged (aside from a no-op Close) for "none".
+func newCompressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "snappy":
+		return snappy.NewBufferedWriter(w), nil
+	default:
+		return nil, fmt.Errorf("S3 unknown compression %q", compression)
+	}
+}
 
 type fileManager struct {
 	Path               string
 	Name               string
+	Beat               string
 	Region             string
 	Bucket             string
 	UploadEveryBytes   *uint64
 	UploadEverySeconds *int64
 	KeepFiles          *int
 
-	current      *os.File
-	current_size uint64
-	last         string
+	// KeyTemplate is a text/template (or one of keyTemplatePresets) evaluated
+	// against keyTemplateData to build the S3 key. KeyPrefix is prepended to
+	// the rendered key, letting multiple beats share a bucket.
+	KeyTemplate string
+	KeyPrefix   string
+
+	// Endpoint, when set, points the uploader at an S3-compatible service
+	// (MinIO, Ceph RadosGW, LocalStack, ...) instead of AWS S3.
+	Endpoint         string
+	AccessKey        string
+	SecretKey        string
+	SessionToken     string
+	DisableSSL       bool
+	S3ForcePathStyle bool
+
+	// Object-level upload options, applied to every object written to S3.
+	ACL                  string
+	StorageClass         string
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	ContentType          string
+	Metadata             map[string]string
+
+	// Compression is one of "none", "gzip", "zstd", or "snappy".
+	Compression string
+
+	// Upload queue tuning. UploadConcurrency workers drain the queue, each
+	// using its own s3manager.Uploader with the given PartSize/Concurrency
+	// for multipart parallelism. MaxRetries failed attempts are retried
+	// with exponential backoff before the file is spooled to disk.
+	UploadConcurrency *int
+	MaxRetries        *int
+	PartSize          int64
+	Concurrency       int
+
+	current        *os.File
+	current_size   uint64
+	firstEventTime time.Time
+	lastEventTime  time.Time
+	sequence       uint64
+
+	startWorkers sync.Once
+	queueMu      sync.Mutex
+	uploadQueue  chan uploadJob
+	lastErrMu    sync.Mutex
+	lastErr      error
+}
+
+// uploadJob is what rotate() hands off to the upload workers: the rotated
+// file plus the timestamps of the first and last lines written into it, so
+// s3Upload can stamp them onto the object as metadata.
+type uploadJob struct {
+	path           string
+	firstEventTime time.Time
+	lastEventTime  time.Time
+	sequence       uint64
+}
+
+// keyTemplateData is the value KeyTemplate is evaluated against.
+type keyTemplateData struct {
+	Time     time.Time
+	Hostname string
+	IP       string
+	Beat     string
+	Name     string
+	Sequence uint64
 }
 
 func (manager *fileManager) createDirectory() error {
@@ -75,6 +206,22 @@ func (manager *fileManager) checkIfConfigSane() error {
 		manager.UploadEverySeconds = new(int64)
 		*manager.UploadEverySeconds = defaultUploadEverySeconds
 	}
+	if manager.UploadConcurrency == nil {
+		manager.UploadConcurrency = new(int)
+		*manager.UploadConcurrency = defaultUploadConcurrency
+	}
+	if manager.MaxRetries == nil {
+		manager.MaxRetries = new(int)
+		*manager.MaxRetries = defaultUploadMaxRetries
+	}
+	if manager.Compression == "" {
+		manager.Compression = defaultCompression
+	}
+	if manager.Compression != "none" {
+		if _, ok := compressionExtensions[manager.Compression]; !ok {
+			return fmt.Errorf("S3 unknown compression %q", manager.Compression)
+		}
+	}
 
 	if *manager.KeepFiles < 2 || *manager.KeepFiles >= managerMaxFiles {
 		return fmt.Errorf("S3 number of files to keep should be between 2 and %d", managerMaxFiles-1)
@@ -97,6 +244,12 @@ func (manager *fileManager) writeLine(line []byte) error {
 	}
 	manager.current_size += uint64(len(line))
 
+	now := time.Now()
+	if manager.firstEventTime.IsZero() {
+		manager.firstEventTime = now
+	}
+	manager.lastEventTime = now
+
 	return nil
 }
 
@@ -152,7 +305,19 @@ func (manager *fileManager) localIP() string {
 	return ""
 }
 
-func (manager *fileManager) s3KeyName() string {
+// keyTemplate resolves manager.KeyTemplate (a preset name or a literal
+// text/template) into a parsed template, falling back to keyTemplateDefault.
+func (manager *fileManager) keyTemplate() (*template.Template, error) {
+	text := manager.KeyTemplate
+	if text == "" {
+		text = keyTemplateDefault
+	} else if preset, ok := keyTemplatePresets[text]; ok {
+		text = preset
+	}
+	return template.New("s3Key").Parse(text)
+}
+
+func (manager *fileManager) s3KeyName(sequence uint64) (string, error) {
 	// Discern hostname or IP address
 	host, err := os.Hostname()
 	if err != nil {
@@ -168,42 +333,112 @@ func (manager *fileManager) s3KeyName() string {
 		host = "localhost"
 	}
 
-	t := time.Now().UTC()
+	tmpl, err := manager.keyTemplate()
+	if err != nil {
+		return "", err
+	}
 
-	timeIso8601 := fmt.Sprintf("%d%02d%02dT%02d%02d%02d.%09dZ",
-		t.Year(), t.Month(), t.Day(),
-		t.Hour(), t.Minute(), t.Second(),
-		t.Nanosecond())
+	data := keyTemplateData{
+		Time:     time.Now().UTC(),
+		Hostname: host,
+		IP:       manager.localIP(),
+		Beat:     manager.Beat,
+		Name:     manager.Name,
+		Sequence: sequence,
+	}
 
-	// Final format is /YYYY/MM/DD/HOST_ISO8601
-	keyName := fmt.Sprintf("/%d/%02d/%02d/%s_%s",
-		t.Year(), t.Month(), t.Day(),
-		host, timeIso8601)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
 
-	return keyName
+	return manager.KeyPrefix + buf.String(), nil
 }
 
-func (manager *fileManager) s3Upload() error {
-	logp.Info("S3 upload path: %v", manager.last)
+func (manager *fileManager) s3Upload(job uploadJob) error {
+	path := job.path
+	logp.Info("S3 upload path: %v", path)
 
-	file, err := os.Open(manager.last)
+	file, err := os.Open(path)
 	if err != nil {
 		logp.Info("S3 err opening file: %s\n", err)
+		return err
 	}
 	defer file.Close()
 
-	// compress
-	reader, writer := io.Pipe()
-	go func() {
-		gw := gzip.NewWriter(writer)
-		io.Copy(gw, file)
-		file.Close()
-		gw.Close()
-		writer.Close()
-	}()
+	var modTime time.Time
+	if info, err := file.Stat(); err == nil {
+		modTime = info.ModTime()
+	} else {
+		logp.Info("S3 err stating file: %s\n", err)
+	}
+
+	// fingerprint the pre-compressed file so it can be verified without
+	// re-downloading and inspecting the (compressed) object later.
+	hasher := sha256.New()
+	origSize, err := io.Copy(hasher, file)
+	if err != nil {
+		logp.Info("S3 err hashing file: %s\n", err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		logp.Info("S3 err seeking file: %s\n", err)
+	}
+	sha256Sum := hex.EncodeToString(hasher.Sum(nil))
+
+	// Compress into a buffer rather than streaming straight into the
+	// Upload() body: ChecksumCRC32C below has to match the bytes S3 actually
+	// receives (the compressed stream), and that checksum isn't known until
+	// compression finishes - which has to happen before Upload() is called,
+	// not concurrently with it.
+	crcHasher := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	var compressed bytes.Buffer
+	cw, err := newCompressWriter(io.MultiWriter(&compressed, crcHasher), manager.Compression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, file); err != nil {
+		logp.Info("S3 err compressing file: %s\n", err)
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		logp.Info("S3 err closing compressor: %s\n", err)
+		return err
+	}
+	crc32cSum := base64.StdEncoding.EncodeToString(crcHasher.Sum(nil))
+	reader := bytes.NewReader(compressed.Bytes())
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = ""
+	}
+
+	metadata := map[string]*string{
+		"hostname":       aws.String(host),
+		"beat-name":      aws.String(manager.Name),
+		"original-bytes": aws.String(strconv.FormatInt(origSize, 10)),
+		"sha256":         aws.String(sha256Sum),
+	}
+	if !modTime.IsZero() {
+		metadata["mtime"] = aws.String(modTime.Format(time.RFC3339Nano))
+	}
+	if !job.firstEventTime.IsZero() {
+		metadata["first-event-time"] = aws.String(job.firstEventTime.Format(time.RFC3339Nano))
+	}
+	if !job.lastEventTime.IsZero() {
+		metadata["last-event-time"] = aws.String(job.lastEventTime.Format(time.RFC3339Nano))
+	}
+	for k, v := range manager.Metadata {
+		metadata[k] = aws.String(v)
+	}
 
 	// aws session
 	cfg := aws.NewConfig().WithRegion(manager.Region)
+	if manager.Endpoint != "" {
+		cfg = cfg.WithEndpoint(manager.Endpoint).WithDisableSSL(manager.DisableSSL).WithS3ForcePathStyle(manager.S3ForcePathStyle)
+	}
+	if manager.AccessKey != "" && manager.SecretKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(manager.AccessKey, manager.SecretKey, manager.SessionToken))
+	}
 	sess, err := session.NewSession(cfg)
 	if err != nil {
 		logp.Info("S3 failed to create session: %v", err)
@@ -211,18 +446,51 @@ func (manager *fileManager) s3Upload() error {
 	}
 
 	// upload
-	key := manager.s3KeyName() + ".gz"
+	keyName, err := manager.s3KeyName(job.sequence)
+	if err != nil {
+		logp.Info("S3 key template error: %v", err)
+		return err
+	}
+	key := keyName + compressionExtensions[manager.Compression]
 
 	params := &s3manager.UploadInput{
-		Body:   reader,
-		Bucket: aws.String(manager.Bucket),
-		Key:    aws.String(key),
+		Body:           reader,
+		Bucket:         aws.String(manager.Bucket),
+		Key:            aws.String(key),
+		Metadata:       metadata,
+		ChecksumCRC32C: aws.String(crc32cSum),
+	}
+	if contentEncoding, ok := compressionContentEncoding[manager.Compression]; ok {
+		params.ContentEncoding = aws.String(contentEncoding)
+	}
+	if manager.ContentType != "" {
+		params.ContentType = aws.String(manager.ContentType)
+	}
+	if manager.ACL != "" {
+		params.ACL = aws.String(manager.ACL)
+	}
+	if manager.StorageClass != "" {
+		params.StorageClass = aws.String(manager.StorageClass)
+	}
+	if manager.ServerSideEncryption != "" {
+		params.ServerSideEncryption = aws.String(manager.ServerSideEncryption)
+		if manager.SSEKMSKeyId != "" {
+			params.SSEKMSKeyId = aws.String(manager.SSEKMSKeyId)
+		}
 	}
 
-	uploader := s3manager.NewUploader(sess)
+	uploader := s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		if manager.PartSize > 0 {
+			u.PartSize = manager.PartSize
+		}
+		if manager.Concurrency > 0 {
+			u.Concurrency = manager.Concurrency
+		}
+	})
 	result, err := uploader.Upload(params)
 	if err != nil {
 		logp.Info("S3 upload failure: %v", err)
+		return err
 	}
 
 	logp.Info("S3 upload success: %v", result.Location)
@@ -230,6 +498,135 @@ func (manager *fileManager) s3Upload() error {
 	return nil
 }
 
+// enqueueUpload hands the rotated file off to the upload workers, starting
+// them (and re-queuing any previously spooled files) on first use. If the
+// queue is full the file is spooled immediately rather than blocking the
+// event pipeline.
+func (manager *fileManager) enqueueUpload(job uploadJob) {
+	manager.startWorkers.Do(manager.startUploadWorkers)
+
+	select {
+	case manager.queue() <- job:
+	default:
+		logp.Info("S3 upload queue full, spooling %s", job.path)
+		manager.spool(job)
+	}
+}
+
+func (manager *fileManager) startUploadWorkers() {
+	manager.queueMu.Lock()
+	manager.uploadQueue = make(chan uploadJob, uploadQueueDepth)
+	manager.queueMu.Unlock()
+
+	for i := 0; i < *manager.UploadConcurrency; i++ {
+		go manager.uploadWorker()
+	}
+	manager.requeueSpooled()
+}
+
+// queue returns the upload queue channel, guarding the read against the
+// concurrent first-use assignment in startUploadWorkers.
+func (manager *fileManager) queue() chan uploadJob {
+	manager.queueMu.Lock()
+	defer manager.queueMu.Unlock()
+	return manager.uploadQueue
+}
+
+func (manager *fileManager) uploadWorker() {
+	for job := range manager.queue() {
+		manager.uploadWithRetry(job)
+	}
+}
+
+// uploadWithRetry retries a failed upload with exponential backoff. If it
+// still fails after MaxRetries retries (MaxRetries+1 attempts in all) the
+// file is spooled to disk so no data is lost across beat restarts.
+func (manager *fileManager) uploadWithRetry(job uploadJob) {
+	delay := uploadRetryBaseDelay
+
+	for attempt := 0; ; attempt++ {
+		err := manager.s3Upload(job)
+		manager.setLastErr(err)
+		if err == nil {
+			// the claimed file lives outside the dot-N rotation, so nothing
+			// else will ever clean it up once it's been uploaded
+			if rmErr := os.Remove(job.path); rmErr != nil && !os.IsNotExist(rmErr) {
+				logp.Info("S3 could not remove uploaded file %s: %v", job.path, rmErr)
+			}
+			return
+		}
+
+		if attempt >= *manager.MaxRetries {
+			logp.Info("S3 upload gave up on %s after %d attempts, spooling: %v", job.path, attempt+1, err)
+			manager.spool(job)
+			return
+		}
+
+		logp.Info("S3 upload attempt %d for %s failed, retrying in %v: %v", attempt+1, job.path, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (manager *fileManager) spoolDir() string {
+	return filepath.Join(manager.Path, "spool")
+}
+
+func (manager *fileManager) spool(job uploadJob) {
+	if err := os.MkdirAll(manager.spoolDir(), 0755); err != nil {
+		logp.Info("S3 could not create spool dir: %v", err)
+		return
+	}
+
+	spoolName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(job.path))
+	dest := filepath.Join(manager.spoolDir(), spoolName)
+	if err := os.Rename(job.path, dest); err != nil {
+		logp.Info("S3 could not spool %s: %v", job.path, err)
+	}
+}
+
+// requeueSpooled re-scans the spool directory on startup so files left
+// behind by a previous run are retried instead of abandoned. The original
+// first/last event times are lost across a restart, so those jobs only
+// carry the file's mtime metadata.
+func (manager *fileManager) requeueSpooled() {
+	entries, err := ioutil.ReadDir(manager.spoolDir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		job := uploadJob{path: filepath.Join(manager.spoolDir(), entry.Name())}
+		select {
+		case manager.queue() <- job:
+		default:
+			logp.Info("S3 upload queue full, leaving %s spooled", job.path)
+		}
+	}
+}
+
+func (manager *fileManager) setLastErr(err error) {
+	manager.lastErrMu.Lock()
+	defer manager.lastErrMu.Unlock()
+	manager.lastErr = err
+}
+
+// LastUploadError returns the error from the most recent upload attempt, if
+// any, so callers can surface S3 output health.
+func (manager *fileManager) LastUploadError() error {
+	manager.lastErrMu.Lock()
+	defer manager.lastErrMu.Unlock()
+	return manager.lastErr
+}
+
+// QueueDepth returns the number of files currently waiting to be uploaded.
+func (manager *fileManager) QueueDepth() int {
+	return len(manager.queue())
+}
+
 func (manager *fileManager) filePath(file_no int) string {
 	if file_no == 0 {
 		return filepath.Join(manager.Path, manager.Name)
@@ -292,15 +689,43 @@ func (manager *fileManager) rotate() error {
 	}
 	manager.current = current
 	manager.current_size = 0
+	firstEventTime := manager.firstEventTime
+	lastEventTime := manager.lastEventTime
+	manager.firstEventTime = time.Time{}
+	manager.lastEventTime = time.Time{}
 
 	// delete the extra file, ignore errors here
 	file_path = manager.filePath(*manager.KeepFiles)
 	os.Remove(file_path)
 
-	// upload the dot-1 file
-	file_path = manager.filePath(1)
-	manager.last = file_path
-	manager.s3Upload()
+	// Claim the dot-1 file under a unique name before handing it to the
+	// upload workers. The queue may not drain it until well after later
+	// rotate() calls have shifted Name.1 -> Name.2 -> ... (retries sleep
+	// with backoff, or a slow UploadConcurrency falls behind ingest), so
+	// the job can't just remember the recycled positional filename - by
+	// the time it's dequeued that path may point at a different file.
+	manager.sequence++
+	claimedPath, err := manager.claimForUpload(manager.filePath(1), manager.sequence)
+	if err != nil {
+		return err
+	}
+	manager.enqueueUpload(uploadJob{
+		path:           claimedPath,
+		firstEventTime: firstEventTime,
+		lastEventTime:  lastEventTime,
+		sequence:       manager.sequence,
+	})
 
 	return nil
 }
+
+// claimForUpload renames a rotated file to a name unique to this upload
+// attempt, so it's safe from being shifted or removed by subsequent
+// rotations while it sits in the upload queue.
+func (manager *fileManager) claimForUpload(path string, sequence uint64) (string, error) {
+	dest := filepath.Join(manager.Path, fmt.Sprintf("%s.upload.%d", manager.Name, sequence))
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
@@ -0,0 +1,107 @@
+package s3
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyTemplatePresets(t *testing.T) {
+	data := keyTemplateData{
+		Time:     time.Date(2026, 7, 26, 13, 4, 5, 0, time.UTC),
+		Hostname: "host",
+		Name:     "myfile",
+		Sequence: 3,
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"empty falls back to default", "", "/2026/07/26/host_20260726T130405.000000000Z"},
+		{"default preset", "default", "/2026/07/26/host_20260726T130405.000000000Z"},
+		{"hourly preset", "hourly", "/2026/07/26/13/host_20260726T130405.000000000Z"},
+		{"hive preset", "hive", "year=2026/month=07/day=26/host_20260726T130405.000000000Z"},
+		{"literal template", "{{.Name}}-{{.Sequence}}", "myfile-3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := &fileManager{KeyTemplate: tt.template}
+			tmpl, err := manager.keyTemplate()
+			if err != nil {
+				t.Fatalf("keyTemplate() error = %v", err)
+			}
+
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, data); err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyTemplateInvalid(t *testing.T) {
+	manager := &fileManager{KeyTemplate: "{{.Nope"}
+	if _, err := manager.keyTemplate(); err == nil {
+		t.Fatal("expected an error parsing a malformed template, got nil")
+	}
+}
+
+func TestS3KeyNameAppliesPrefix(t *testing.T) {
+	manager := &fileManager{
+		Name:        "myfile",
+		KeyTemplate: "{{.Name}}",
+		KeyPrefix:   "prefix/",
+	}
+
+	got, err := manager.s3KeyName(1)
+	if err != nil {
+		t.Fatalf("s3KeyName() error = %v", err)
+	}
+
+	want := "prefix/myfile"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewCompressWriter(t *testing.T) {
+	tests := []string{"", "none", "gzip", "zstd", "snappy"}
+
+	for _, compression := range tests {
+		t.Run(compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			cw, err := newCompressWriter(&buf, compression)
+			if err != nil {
+				t.Fatalf("newCompressWriter(%q) error = %v", compression, err)
+			}
+
+			if _, err := cw.Write([]byte("hello world")); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if buf.Len() == 0 {
+				t.Error("expected compressed output, got none")
+			}
+		})
+	}
+}
+
+func TestNewCompressWriterUnknown(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := newCompressWriter(&buf, "bogus"); err == nil {
+		t.Fatal("expected an error for an unknown compression, got nil")
+	} else if !strings.Contains(err.Error(), "bogus") {
+		t.Errorf("expected error to mention the unknown compression, got %v", err)
+	}
+}